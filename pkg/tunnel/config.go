@@ -0,0 +1,88 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"net/netip"
+)
+
+// Dialer dials outbound connections on behalf of the embedded SOCKS5
+// server. Implementations can route through an SSH or WebSocket transport
+// instead of the host network directly.
+type Dialer interface {
+	Dial(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// directDialer dials the host network directly, the default when no
+// Dialer is configured.
+type directDialer struct {
+	net.Dialer
+}
+
+func (d *directDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.DialContext(ctx, network, addr)
+}
+
+// Config configures the embedded SOCKS5 server and the interface it's
+// wired to.
+type Config struct {
+	// ListenAddr is where the embedded SOCKS5 server listens, e.g.
+	// "127.0.0.1:1080". Defaults to socksAddr.
+	ListenAddr string
+
+	// Username and Password enable RFC 1929 username/password auth on the
+	// SOCKS5 server. If both are empty, the server accepts unauthenticated
+	// clients.
+	Username string
+	Password string
+
+	// Dialer dials outbound connections for accepted SOCKS5 requests.
+	// Defaults to dialing the host network directly.
+	Dialer Dialer
+
+	// Verbose enables debug-level per-packet logging.
+	Verbose bool
+
+	// Include lists the prefixes that should be routed through the
+	// tunnel. An empty Include routes everything (a full-tunnel setup).
+	Include []netip.Prefix
+
+	// Exclude lists prefixes that must bypass the tunnel even if they
+	// fall inside an Include prefix (or the implicit full-tunnel
+	// default). Matching flows are dialed directly from the host
+	// instead of through the SOCKS5 proxy.
+	Exclude []netip.Prefix
+}
+
+// withDefaults returns a copy of cfg with zero-valued fields filled in.
+func (cfg Config) withDefaults() Config {
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = socksAddr
+	}
+	if cfg.Dialer == nil {
+		cfg.Dialer = &directDialer{}
+	}
+	return cfg
+}
+
+// requiresAuth reports whether clients must authenticate.
+func (cfg Config) requiresAuth() bool {
+	return cfg.Username != "" || cfg.Password != ""
+}
+
+// fullTunnelPrefixes are the routes installed when Include is empty, so
+// "an empty Include routes everything" actually routes everything rather
+// than nothing.
+var fullTunnelPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/0"),
+	netip.MustParsePrefix("::/0"),
+}
+
+// effectiveIncludes returns the prefixes that should be routed through the
+// tunnel, substituting the full-tunnel default when Include is empty.
+func (cfg Config) effectiveIncludes() []netip.Prefix {
+	if len(cfg.Include) == 0 {
+		return fullTunnelPrefixes
+	}
+	return cfg.Include
+}
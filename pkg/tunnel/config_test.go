@@ -0,0 +1,38 @@
+package tunnel
+
+import "testing"
+
+func TestConfigWithDefaults(t *testing.T) {
+	cfg := Config{}.withDefaults()
+	if cfg.ListenAddr != socksAddr {
+		t.Errorf("ListenAddr = %q, want %q", cfg.ListenAddr, socksAddr)
+	}
+	if cfg.Dialer == nil {
+		t.Error("Dialer should default to a non-nil direct dialer")
+	}
+
+	cfg = Config{ListenAddr: "127.0.0.1:9050"}.withDefaults()
+	if cfg.ListenAddr != "127.0.0.1:9050" {
+		t.Errorf("ListenAddr should not be overridden, got %q", cfg.ListenAddr)
+	}
+}
+
+func TestConfigRequiresAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want bool
+	}{
+		{"empty", Config{}, false},
+		{"username only", Config{Username: "alice"}, true},
+		{"password only", Config{Password: "hunter2"}, true},
+		{"both", Config{Username: "alice", Password: "hunter2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.requiresAuth(); got != tt.want {
+				t.Errorf("requiresAuth() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package tunnel
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	flowsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnel_flows_total",
+		Help: "Total number of flows opened, by protocol.",
+	}, []string{"proto"})
+
+	bytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnel_bytes_total",
+		Help: "Total bytes transferred, by direction.",
+	}, []string{"dir"})
+
+	flowDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tunnel_flow_duration_seconds",
+		Help:    "Duration of tunnel flows from open to close.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"proto"})
+
+	activeFlows = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tunnel_active_flows",
+		Help: "Number of flows currently open.",
+	})
+)
+
+// Handler returns an http.Handler that serves the tunnel's Prometheus
+// metrics, for callers that want to expose them on their own mux.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,407 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"golang.zx2c4.com/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const nicID tcpip.NICID = 1
+
+// udpIdleTimeout is how long a UDP flow (e.g. a DNS query) can go without
+// the TUN side sending another datagram before its SOCKS5 UDP ASSOCIATE
+// session is torn down. gvisor hands out one endpoint per 5-tuple and
+// never tells us when the application is done with it, so without this
+// every UDP flow would leak its control conn, relay socket, and goroutines
+// forever.
+const udpIdleTimeout = 2 * time.Minute
+
+// netStack wraps a gvisor userspace network stack bound to a TUN device. It
+// reads packets off the device, hands TCP connections to the SOCKS5 client,
+// and writes replies back out.
+type netStack struct {
+	stack     *stack.Stack
+	endpoint  *channel.Endpoint
+	device    tun.Device
+	dialer    proxy.Dialer
+	socksAddr string
+	username  string
+	password  string
+	verbose   bool
+	cancel    context.CancelFunc
+
+	udpMu       sync.Mutex
+	udpSessions map[tcpip.TransportEndpointID]*socks5UDPAssociate
+
+	excludesMu sync.RWMutex
+	excludes   []netip.Prefix
+}
+
+// newNetStack wires device into a gvisor stack that dials cfg.ListenAddr,
+// authenticating with cfg.Username/Password when set, for every flow whose
+// destination is not in the exclude list set by SetExcludes.
+func newNetStack(device tun.Device, cfg Config) (*netStack, error) {
+	var auth *proxy.Auth
+	if cfg.requiresAuth() {
+		auth = &proxy.Auth{User: cfg.Username, Password: cfg.Password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", cfg.ListenAddr, auth, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("netstack: build socks5 dialer: %w", err)
+	}
+
+	endpoint := channel.New(512, uint32(interfaceMTU), "")
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	if err := s.CreateNIC(nicID, endpoint); err != nil {
+		return nil, fmt.Errorf("netstack: create nic: %s", err)
+	}
+	s.SetPromiscuousMode(nicID, true)
+	s.SetSpoofing(nicID, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicID},
+		{Destination: header.IPv6EmptySubnet, NIC: nicID},
+	})
+
+	ns := &netStack{
+		stack:       s,
+		endpoint:    endpoint,
+		device:      device,
+		dialer:      dialer,
+		socksAddr:   cfg.ListenAddr,
+		username:    cfg.Username,
+		password:    cfg.Password,
+		verbose:     cfg.Verbose,
+		udpSessions: make(map[tcpip.TransportEndpointID]*socks5UDPAssociate),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ns.cancel = cancel
+
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcp.NewForwarder(s, 0, 2048, ns.forwardTCP).HandlePacket)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udp.NewForwarder(s, ns.forwardUDP).HandlePacket)
+
+	go ns.readFromDevice(ctx)
+	go ns.writeToDevice(ctx)
+
+	return ns, nil
+}
+
+// forwardTCP dials socksAddr for each new TCP flow accepted off the TUN
+// device (or the destination directly, if it is excluded) and splices the
+// two connections together.
+func (ns *netStack) forwardTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		slog.Warn("tcp flow rejected", "error", err)
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+
+	local := gonet.NewTCPConn(&wq, ep)
+	dst := net.JoinHostPort(id.LocalAddress.String(), fmt.Sprintf("%d", id.LocalPort))
+
+	var remote net.Conn
+	if addr := addrFromTcpip(id.LocalAddress); ns.isExcluded(addr) {
+		slog.Debug("split-tunnel bypass", "dst", dst)
+		remote, err = net.Dial("tcp", dst)
+	} else {
+		slog.Debug("socks5 dial", "dst", dst)
+		remote, err = ns.dialer.Dial("tcp", dst)
+	}
+	if err != nil {
+		slog.Warn("dial failed", "dst", dst, "error", err)
+		local.Close()
+		return
+	}
+
+	slog.Info("tcp flow open", "dst", dst)
+	flowsTotal.WithLabelValues("tcp").Inc()
+	activeFlows.Inc()
+	go func() {
+		defer activeFlows.Dec()
+		start := time.Now()
+		in, out := pipe(local, remote, dst, ns.verbose)
+		flowDuration.WithLabelValues("tcp").Observe(time.Since(start).Seconds())
+		slog.Info("tcp flow closed", "dst", dst, "bytes_in", in, "bytes_out", out, "duration", time.Since(start))
+	}()
+}
+
+// forwardUDP opens a SOCKS5 UDP ASSOCIATE session for each new UDP flow
+// accepted off the TUN device and relays datagrams in both directions until
+// the flow's gvisor endpoint closes. Flows to excluded destinations are
+// instead dialed directly over UDP from the host.
+func (ns *netStack) forwardUDP(r *udp.ForwarderRequest) {
+	id := r.ID()
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		slog.Warn("udp flow rejected", "error", err)
+		return
+	}
+	local := gonet.NewUDPConn(ns.stack, &wq, ep)
+	dst := netip.AddrPortFrom(addrFromTcpip(id.LocalAddress), id.LocalPort)
+
+	if ns.isExcluded(dst.Addr()) {
+		slog.Debug("split-tunnel bypass", "dst", dst)
+		remote, err := net.Dial("udp", dst.String())
+		if err != nil {
+			slog.Warn("direct udp dial failed", "dst", dst, "error", err)
+			local.Close()
+			return
+		}
+		flowsTotal.WithLabelValues("udp").Inc()
+		activeFlows.Inc()
+		slog.Info("udp flow open (bypass)", "dst", dst)
+		go func() {
+			defer activeFlows.Dec()
+			start := time.Now()
+			in, out := pipe(local, remote, dst.String(), ns.verbose)
+			flowDuration.WithLabelValues("udp").Observe(time.Since(start).Seconds())
+			slog.Info("udp flow closed", "dst", dst, "bytes_in", in, "bytes_out", out)
+		}()
+		return
+	}
+
+	session, err := dialSOCKS5UDPAssociate(ns.socksAddr, ns.username, ns.password)
+	if err != nil {
+		slog.Warn("socks5 udp associate failed", "error", err)
+		local.Close()
+		return
+	}
+
+	ns.udpMu.Lock()
+	ns.udpSessions[id] = session
+	ns.udpMu.Unlock()
+
+	slog.Info("udp flow open", "dst", dst)
+	flowsTotal.WithLabelValues("udp").Inc()
+	activeFlows.Inc()
+
+	go ns.relayUDPToSocks(local, session, dst, time.Now())
+	go ns.relayUDPFromSocks(local, session, id)
+}
+
+// relayUDPToSocks reads datagrams the netstack hands us from the TUN side
+// and forwards them through the SOCKS UDP relay.
+func (ns *netStack) relayUDPToSocks(local net.Conn, session *socks5UDPAssociate, dst netip.AddrPort, start time.Time) {
+	defer ns.closeUDPSession(session, dst, start)
+	buf := make([]byte, interfaceMTU)
+	for {
+		local.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := local.Read(buf)
+		if err != nil {
+			return
+		}
+		if err := session.Send(dst, buf[:n]); err != nil {
+			slog.Warn("socks5 udp send failed", "dst", dst, "error", err)
+			return
+		}
+		bytesTotal.WithLabelValues("out").Add(float64(n))
+	}
+}
+
+// relayUDPFromSocks reads relay replies and writes them back onto the TUN
+// device's 5-tuple for this flow.
+func (ns *netStack) relayUDPFromSocks(local net.Conn, session *socks5UDPAssociate, id tcpip.TransportEndpointID) {
+	buf := make([]byte, interfaceMTU)
+	for {
+		_, payload, err := session.Receive(buf)
+		if err != nil {
+			local.Close()
+			return
+		}
+		if _, err := local.Write(payload); err != nil {
+			return
+		}
+		bytesTotal.WithLabelValues("in").Add(float64(len(payload)))
+	}
+}
+
+// closeUDPSession tears down a UDP ASSOCIATE session, removes it from the
+// active flow table, and records its final metrics.
+func (ns *netStack) closeUDPSession(session *socks5UDPAssociate, dst netip.AddrPort, start time.Time) {
+	session.Close()
+	ns.udpMu.Lock()
+	for id, s := range ns.udpSessions {
+		if s == session {
+			delete(ns.udpSessions, id)
+		}
+	}
+	ns.udpMu.Unlock()
+
+	activeFlows.Dec()
+	flowDuration.WithLabelValues("udp").Observe(time.Since(start).Seconds())
+	slog.Info("udp flow closed", "dst", dst, "duration", time.Since(start))
+}
+
+// addrFromTcpip converts a gvisor network address into a netip.Addr.
+func addrFromTcpip(addr tcpip.Address) netip.Addr {
+	if a, ok := netip.AddrFromSlice(addr.AsSlice()); ok {
+		return a
+	}
+	return netip.Addr{}
+}
+
+// pipe copies data in both directions until either side closes, then closes
+// both ends. It returns the bytes copied a->b (out) and b->a (in).
+func pipe(a, b net.Conn, label string, verbose bool) (in, out int64) {
+	done := make(chan struct{}, 2)
+	go func() {
+		out = copyCounting(b, a, "out", label, verbose)
+		done <- struct{}{}
+	}()
+	go func() {
+		in = copyCounting(a, b, "in", label, verbose)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+	return in, out
+}
+
+// copyCounting copies from src to dst, recording bytes_total and, when
+// verbose is set, logging each write. The hot path stays a plain io.Copy
+// when verbose logging is off.
+func copyCounting(dst, src net.Conn, dir, label string, verbose bool) int64 {
+	if !verbose {
+		n, _ := io.Copy(dst, src)
+		bytesTotal.WithLabelValues(dir).Add(float64(n))
+		return n
+	}
+
+	buf := make([]byte, 32*1024)
+	var total int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				break
+			}
+			total += int64(n)
+			bytesTotal.WithLabelValues(dir).Add(float64(n))
+			slog.Debug("packet", "dst", label, "dir", dir, "bytes", n)
+		}
+		if err != nil {
+			break
+		}
+	}
+	return total
+}
+
+// readFromDevice pumps packets from the TUN device into the gvisor stack.
+func (ns *netStack) readFromDevice(ctx context.Context) {
+	bufs := make([][]byte, 1)
+	sizes := make([]int, 1)
+	buf := make([]byte, interfaceMTU+16)
+	for ctx.Err() == nil {
+		bufs[0] = buf
+		n, err := ns.device.Read(bufs, sizes, 0)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("tun read failed", "error", err)
+			}
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		if ns.verbose {
+			slog.Debug("tun read", "bytes", sizes[0])
+		}
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: bufferFromSlice(buf[:sizes[0]]),
+		})
+		ns.endpoint.InjectInbound(ipVersion(buf), pkt)
+	}
+}
+
+// writeToDevice pumps packets the stack produces back out to the TUN device.
+func (ns *netStack) writeToDevice(ctx context.Context) {
+	for ctx.Err() == nil {
+		pkt := ns.endpoint.ReadContext(ctx)
+		if pkt == nil {
+			continue
+		}
+		view := pkt.ToView()
+		pkt.DecRef()
+		if _, err := ns.device.Write([][]byte{view.AsSlice()}, 0); err != nil {
+			slog.Warn("tun write failed", "error", err)
+		}
+	}
+}
+
+// Close tears down the stack and stops the device pumps.
+func (ns *netStack) Close() {
+	if ns.cancel != nil {
+		ns.cancel()
+	}
+	ns.stack.Close()
+}
+
+// SetExcludes replaces the set of prefixes that must bypass the SOCKS5
+// proxy and be dialed directly from the host instead. Safe to call while
+// flows are in flight.
+func (ns *netStack) SetExcludes(excludes []netip.Prefix) {
+	ns.excludesMu.Lock()
+	ns.excludes = excludes
+	ns.excludesMu.Unlock()
+}
+
+// isExcluded reports whether addr falls inside one of the configured
+// Exclude prefixes and should bypass the tunnel.
+func (ns *netStack) isExcluded(addr netip.Addr) bool {
+	ns.excludesMu.RLock()
+	defer ns.excludesMu.RUnlock()
+	for _, prefix := range ns.excludes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferFromSlice copies b into a gvisor buffer.Buffer for injection into
+// the stack.
+func bufferFromSlice(b []byte) buffer.Buffer {
+	buf := buffer.MakeWithData(append([]byte(nil), b...))
+	return buf
+}
+
+// ipVersion returns the network protocol number for the IP version encoded
+// in the first nibble of an IP packet.
+func ipVersion(b []byte) tcpip.NetworkProtocolNumber {
+	if len(b) == 0 {
+		return ipv4.ProtocolNumber
+	}
+	if b[0]>>4 == 6 {
+		return ipv6.ProtocolNumber
+	}
+	return ipv4.ProtocolNumber
+}
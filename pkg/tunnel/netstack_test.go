@@ -0,0 +1,41 @@
+package tunnel
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestNetStackIsExcluded(t *testing.T) {
+	ns := &netStack{excludes: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+	}}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.1.5", true},
+		{"192.168.2.5", false},
+		{"8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		got := ns.isExcluded(netip.MustParseAddr(tt.addr))
+		if got != tt.want {
+			t.Errorf("isExcluded(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestNetStackSetExcludes(t *testing.T) {
+	ns := &netStack{}
+	addr := netip.MustParseAddr("172.16.5.1")
+	if ns.isExcluded(addr) {
+		t.Fatal("no excludes configured, expected isExcluded to return false")
+	}
+	ns.SetExcludes([]netip.Prefix{netip.MustParsePrefix("172.16.0.0/16")})
+	if !ns.isExcluded(addr) {
+		t.Fatal("expected isExcluded to return true after SetExcludes")
+	}
+}
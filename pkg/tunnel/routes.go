@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// nonPathChars matches characters that can't safely appear in a file name,
+// so an interface name can be embedded in routeStatePath.
+var nonPathChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// routeStatePath returns the path of the crash-recovery state file for the
+// tunnel interface named name. Keying it by interface name keeps two
+// tunnels (or a second process racing the first) from clobbering each
+// other's route records.
+func routeStatePath(name string) string {
+	safe := nonPathChars.ReplaceAllString(name, "_")
+	return filepath.Join(os.TempDir(), fmt.Sprintf("sst-tunnel-routes-%s.json", safe))
+}
+
+// routeState is the on-disk record of installed routes for one interface.
+type routeState struct {
+	CIDRs []string `json:"cidrs"`
+}
+
+// saveRouteState persists the current route set for crash recovery.
+func saveRouteState(name string, cidrs []string) error {
+	f, err := os.Create(routeStatePath(name))
+	if err != nil {
+		return fmt.Errorf("tunnel: write route state: %w", err)
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(routeState{CIDRs: cidrs})
+}
+
+// clearRouteState removes the state file after a clean shutdown.
+func clearRouteState(name string) {
+	if err := os.Remove(routeStatePath(name)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("tunnel: failed to remove route state file", "error", err)
+	}
+}
+
+// recoverStaleRoutes removes any routes left behind by a previous process
+// that didn't exit cleanly (e.g. SIGKILL), using the on-disk state file for
+// the interface named name.
+func recoverStaleRoutes(name string) {
+	data, err := os.ReadFile(routeStatePath(name))
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		slog.Warn("tunnel: failed to read route state file", "error", err)
+		return
+	}
+
+	var state routeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		slog.Warn("tunnel: corrupt route state file, removing", "error", err)
+		clearRouteState(name)
+		return
+	}
+
+	for _, cidr := range state.CIDRs {
+		if err := removeRoute(name, cidr); err != nil {
+			slog.Debug("tunnel: stale route cleanup failed", "cidr", cidr, "error", err)
+		}
+	}
+	slog.Info("tunnel: recovered routes from a previous run", "interface", name, "count", len(state.CIDRs))
+	clearRouteState(name)
+}
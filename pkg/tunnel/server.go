@@ -0,0 +1,342 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// socks5Version is the protocol version byte used throughout RFC 1928.
+const socks5Version = 0x05
+
+const (
+	authNone         = 0x00
+	authUserPass     = 0x02
+	authNoAcceptable = 0xff
+)
+
+const (
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+)
+
+// Server is an embedded SOCKS5 server (RFC 1928, with RFC 1929
+// username/password auth) that dials outbound connections through a
+// pluggable Dialer. It lets the tunnel run as a single Go binary with no
+// external SOCKS5 process.
+type Server struct {
+	cfg Config
+}
+
+// NewServer returns a Server configured by cfg, filling in defaults for any
+// zero-valued fields.
+func NewServer(cfg Config) *Server {
+	return &Server{cfg: cfg.withDefaults()}
+}
+
+// Serve listens on the configured address and handles SOCKS5 clients until
+// ctx is done or the listener fails.
+func (s *Server) Serve(ctx context.Context) error {
+	lc := net.ListenConfig{}
+	ln, err := lc.Listen(ctx, "tcp", s.cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("socks5 server: listen %s: %w", s.cfg.ListenAddr, err)
+	}
+	defer ln.Close()
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	slog.Info("socks5 server listening", "addr", s.cfg.ListenAddr, "auth", s.cfg.requiresAuth())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("socks5 server: accept: %w", err)
+		}
+		go s.handleConn(ctx, conn)
+	}
+}
+
+// handleConn negotiates a method, authenticates if required, and dispatches
+// the requested command.
+func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	if err := s.negotiateAuth(conn); err != nil {
+		slog.Warn("socks5 server: auth failed", "error", err)
+		return
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		slog.Warn("socks5 server: read request", "error", err)
+		return
+	}
+	if header[0] != socks5Version {
+		slog.Warn("socks5 server: unsupported version", "version", header[0])
+		return
+	}
+
+	addr, port, err := readSOCKS5Address(conn, header[3])
+	if err != nil {
+		slog.Warn("socks5 server: read address", "error", err)
+		return
+	}
+	dst := net.JoinHostPort(addr, fmt.Sprintf("%d", port))
+
+	switch header[1] {
+	case cmdConnect:
+		s.handleConnect(ctx, conn, dst)
+	case cmdUDPAssociate:
+		s.handleUDPAssociate(ctx, conn)
+	default:
+		writeSOCKS5Reply(conn, 0x07) // command not supported
+	}
+}
+
+// negotiateAuth performs the RFC 1928 method selection and, if the server
+// requires it, the RFC 1929 username/password exchange.
+func (s *Server) negotiateAuth(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("read greeting: %w", err)
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("read methods: %w", err)
+	}
+
+	want := byte(authNone)
+	if s.cfg.requiresAuth() {
+		want = authUserPass
+	}
+	selected := authNoAcceptable
+	for _, m := range methods {
+		if m == want {
+			selected = int(want)
+			break
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, byte(selected)}); err != nil {
+		return fmt.Errorf("write method selection: %w", err)
+	}
+	if selected == authNoAcceptable {
+		return fmt.Errorf("no acceptable auth method in %v", methods)
+	}
+	if selected == authNone {
+		return nil
+	}
+
+	return s.checkUserPass(conn)
+}
+
+// checkUserPass implements the RFC 1929 username/password sub-negotiation.
+func (s *Server) checkUserPass(conn net.Conn) error {
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("read auth version: %w", err)
+	}
+
+	ulen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ulen); err != nil {
+		return err
+	}
+	user := make([]byte, ulen[0])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plen); err != nil {
+		return err
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return err
+	}
+
+	ok := string(user) == s.cfg.Username && string(pass) == s.cfg.Password
+	status := byte(0x01)
+	if ok {
+		status = 0x00
+	}
+	if _, err := conn.Write([]byte{0x01, status}); err != nil {
+		return fmt.Errorf("write auth status: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("invalid credentials for user %q", user)
+	}
+	return nil
+}
+
+// handleConnect dials dst through the configured Dialer and splices the
+// client connection to it.
+func (s *Server) handleConnect(ctx context.Context, conn net.Conn, dst string) {
+	remote, err := s.cfg.Dialer.Dial(ctx, "tcp", dst)
+	if err != nil {
+		slog.Warn("socks5 server: dial failed", "dst", dst, "error", err)
+		writeSOCKS5Reply(conn, 0x05) // connection refused
+		return
+	}
+	defer remote.Close()
+
+	writeSOCKS5Reply(conn, 0x00)
+	slog.Info("socks5 connect", "dst", dst)
+	flowsTotal.WithLabelValues("tcp").Inc()
+	activeFlows.Inc()
+	defer activeFlows.Dec()
+
+	start := time.Now()
+	in, out := pipe(conn, remote, dst, s.cfg.Verbose)
+	flowDuration.WithLabelValues("tcp").Observe(time.Since(start).Seconds())
+	slog.Info("socks5 connect closed", "dst", dst, "bytes_in", in, "bytes_out", out, "duration", time.Since(start))
+}
+
+// handleUDPAssociate opens a UDP relay socket, tells the client where to
+// send datagrams, and forwards them to their SOCKS-framed destinations
+// through the configured Dialer until the control connection closes.
+func (s *Server) handleUDPAssociate(ctx context.Context, conn net.Conn) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		slog.Warn("socks5 server: udp associate listen failed", "error", err)
+		writeSOCKS5Reply(conn, 0x01) // general failure
+		return
+	}
+	defer relay.Close()
+
+	port := relay.LocalAddr().(*net.UDPAddr).Port
+	reply := []byte{socks5Version, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+	// BND.ADDR should be an address the client can actually reach us on,
+	// not the relay socket's unspecified bind address. The address the
+	// client dialed to reach this control connection is the best guess.
+	if host, _, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+			copy(reply[4:8], ip.To4())
+		}
+	}
+	binary.BigEndian.PutUint16(reply[8:], uint16(port))
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+
+	destConns := make(map[string]net.Conn)
+	defer func() {
+		for _, c := range destConns {
+			c.Close()
+		}
+	}()
+
+	clientAddr, buf := (*net.UDPAddr)(nil), make([]byte, interfaceMTU)
+	go func() {
+		// The control connection stays open only to detect when the
+		// client tears the association down.
+		io.Copy(io.Discard, conn)
+		relay.Close()
+	}()
+
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		dst, payload, err := decodeSOCKS5UDPHeader(buf[:n])
+		if err != nil {
+			slog.Debug("socks5 server: dropping udp datagram", "error", err)
+			continue
+		}
+		if clientAddr == nil {
+			clientAddr = from
+		}
+
+		key := dst.String()
+		remote, ok := destConns[key]
+		if !ok {
+			remote, err = s.cfg.Dialer.Dial(ctx, "udp", dst.String())
+			if err != nil {
+				slog.Warn("socks5 server: udp dial failed", "dst", dst, "error", err)
+				continue
+			}
+			destConns[key] = remote
+			go s.relayUDPReplies(relay, remote, clientAddr, dst)
+		}
+		remote.Write(payload)
+	}
+}
+
+// relayUDPReplies copies datagrams from remote back to the client, wrapping
+// each in a SOCKS UDP header addressed from src.
+func (s *Server) relayUDPReplies(relay *net.UDPConn, remote net.Conn, client *net.UDPAddr, src netip.AddrPort) {
+	buf := make([]byte, interfaceMTU)
+	for {
+		n, err := remote.Read(buf)
+		if err != nil {
+			return
+		}
+		header := encodeSOCKS5UDPHeader(src)
+		relay.WriteToUDP(append(header, buf[:n]...), client)
+	}
+}
+
+// writeSOCKS5Reply writes a CONNECT/ASSOCIATE reply with the given status
+// code and a 0.0.0.0:0 bound address, which is sufficient for clients that
+// only care about success/failure.
+func writeSOCKS5Reply(conn net.Conn, status byte) {
+	conn.Write([]byte{socks5Version, status, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+}
+
+// readSOCKS5Address reads a DST.ADDR/DST.PORT pair for the given ATYP.
+func readSOCKS5Address(conn net.Conn, atyp byte) (string, uint16, error) {
+	var addr string
+	switch atyp {
+	case 0x01:
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", 0, err
+		}
+		addr = net.IP(b).String()
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return "", 0, err
+		}
+		b := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", 0, err
+		}
+		addr = string(b)
+	case 0x04:
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", 0, err
+		}
+		addr = net.IP(b).String()
+	default:
+		return "", 0, fmt.Errorf("unknown ATYP %d", atyp)
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return "", 0, err
+	}
+	return addr, binary.BigEndian.Uint16(portBytes), nil
+}
+
+// Serve starts an embedded SOCKS5 server with the given configuration and
+// blocks until ctx is done.
+func Serve(ctx context.Context, cfg Config) error {
+	return NewServer(cfg).Serve(ctx)
+}
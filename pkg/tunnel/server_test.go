@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReadSOCKS5AddressIPv4(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go server.Write([]byte{10, 0, 0, 1, 0x00, 0x50})
+
+	addr, port, err := readSOCKS5Address(client, 0x01)
+	if err != nil {
+		t.Fatalf("readSOCKS5Address: %v", err)
+	}
+	if addr != "10.0.0.1" || port != 80 {
+		t.Errorf("got %s:%d, want 10.0.0.1:80", addr, port)
+	}
+}
+
+func TestReadSOCKS5AddressDomain(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	name := "example.com"
+	msg := append([]byte{byte(len(name))}, name...)
+	msg = append(msg, 0x01, 0xBB)
+	go server.Write(msg)
+
+	addr, port, err := readSOCKS5Address(client, 0x03)
+	if err != nil {
+		t.Fatalf("readSOCKS5Address: %v", err)
+	}
+	if addr != name || port != 443 {
+		t.Errorf("got %s:%d, want %s:443", addr, port, name)
+	}
+}
+
+func TestReadSOCKS5AddressUnknownATYP(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	if _, _, err := readSOCKS5Address(client, 0x7F); err == nil {
+		t.Fatal("expected an error for an unknown ATYP, got nil")
+	}
+}
@@ -0,0 +1,263 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+)
+
+// socks5UDPAssociate is a single SOCKS5 UDP ASSOCIATE session (RFC 1928
+// section 7). The control connection must stay open for the life of the
+// relay; closing it tells the server to tear the association down.
+type socks5UDPAssociate struct {
+	control net.Conn
+	relay   net.Conn // UDP connection to BND.ADDR:BND.PORT
+}
+
+// dialSOCKS5UDPAssociate opens a control connection to addr, negotiates
+// auth (sending username/password if the server requires it), issues a UDP
+// ASSOCIATE request, and dials the relay address the server returns.
+func dialSOCKS5UDPAssociate(addr, username, password string) (*socks5UDPAssociate, error) {
+	control, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 udp: dial control conn: %w", err)
+	}
+
+	selected, err := greetSOCKS5(control, username != "" || password != "")
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	if selected == authUserPass {
+		if err := authenticateSOCKS5(control, username, password); err != nil {
+			control.Close()
+			return nil, err
+		}
+	}
+
+	// UDP ASSOCIATE request with a 0.0.0.0:0 placeholder client address.
+	req := []byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+	if _, err := control.Write(req); err != nil {
+		control.Close()
+		return nil, fmt.Errorf("socks5 udp: send associate request: %w", err)
+	}
+
+	bndAddr, bndPort, err := readSOCKS5Reply(control)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	// Servers commonly reply with an unspecified BND.ADDR (e.g. 0.0.0.0)
+	// since they don't know which local address the client reached them
+	// on. Per RFC 1928, substitute the control connection's remote
+	// address in that case; dialing 0.0.0.0 verbatim isn't portable
+	// across platforms and the server's replies wouldn't reach us anyway.
+	if ip, err := netip.ParseAddr(bndAddr); err == nil && ip.IsUnspecified() {
+		if host, _, err := net.SplitHostPort(control.RemoteAddr().String()); err == nil {
+			bndAddr = host
+		}
+	}
+
+	relay, err := net.Dial("udp", net.JoinHostPort(bndAddr, fmt.Sprintf("%d", bndPort)))
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("socks5 udp: dial relay %s:%d: %w", bndAddr, bndPort, err)
+	}
+
+	return &socks5UDPAssociate{control: control, relay: relay}, nil
+}
+
+// greetSOCKS5 sends the RFC 1928 method-selection greeting, offering
+// username/password as well as no-auth when withAuth is set, and returns
+// the method the server selected.
+func greetSOCKS5(conn net.Conn, withAuth bool) (byte, error) {
+	greeting := []byte{0x05, 0x01, authNone}
+	if withAuth {
+		greeting = []byte{0x05, 0x02, authNone, authUserPass}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return 0, fmt.Errorf("socks5 udp: send greeting: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0, fmt.Errorf("socks5 udp: read greeting reply: %w", err)
+	}
+	if reply[0] != 0x05 || reply[1] == authNoAcceptable {
+		return 0, fmt.Errorf("socks5 udp: server rejected auth method %d", reply[1])
+	}
+	return reply[1], nil
+}
+
+// authenticateSOCKS5 performs the RFC 1929 username/password sub-negotiation.
+func authenticateSOCKS5(conn net.Conn, username, password string) error {
+	req := make([]byte, 0, 3+len(username)+len(password))
+	req = append(req, 0x01, byte(len(username)))
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("socks5 udp: send auth: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("socks5 udp: read auth reply: %w", err)
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("socks5 udp: authentication rejected")
+	}
+	return nil
+}
+
+// readSOCKS5Reply parses a CONNECT/ASSOCIATE reply and returns BND.ADDR and
+// BND.PORT.
+func readSOCKS5Reply(conn net.Conn) (string, uint16, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", 0, fmt.Errorf("socks5 udp: read reply header: %w", err)
+	}
+	if header[0] != 0x05 {
+		return "", 0, fmt.Errorf("socks5 udp: unexpected reply version %d", header[0])
+	}
+	if header[1] != 0x00 {
+		return "", 0, fmt.Errorf("socks5 udp: server returned error code %d", header[1])
+	}
+
+	var addr string
+	switch header[3] {
+	case 0x01: // IPv4
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", 0, err
+		}
+		addr = net.IP(b).String()
+	case 0x03: // domain name
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return "", 0, err
+		}
+		b := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", 0, err
+		}
+		addr = string(b)
+	case 0x04: // IPv6
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", 0, err
+		}
+		addr = net.IP(b).String()
+	default:
+		return "", 0, fmt.Errorf("socks5 udp: unknown ATYP %d in reply", header[3])
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return "", 0, err
+	}
+	return addr, binary.BigEndian.Uint16(portBytes), nil
+}
+
+// Close tears down both the relay socket and the control connection.
+func (a *socks5UDPAssociate) Close() error {
+	a.relay.Close()
+	return a.control.Close()
+}
+
+// Send wraps payload in a SOCKS UDP header addressed to dst and writes it to
+// the relay.
+func (a *socks5UDPAssociate) Send(dst netip.AddrPort, payload []byte) error {
+	header := encodeSOCKS5UDPHeader(dst)
+	_, err := a.relay.Write(append(header, payload...))
+	return err
+}
+
+// Receive reads one datagram from the relay and strips the SOCKS UDP
+// header, returning the original source address and payload. Fragmented
+// datagrams (FRAG != 0) are dropped since fragmentation is optional.
+func (a *socks5UDPAssociate) Receive(buf []byte) (netip.AddrPort, []byte, error) {
+	for {
+		n, err := a.relay.Read(buf)
+		if err != nil {
+			return netip.AddrPort{}, nil, err
+		}
+		if n >= 3 && buf[2] != 0x00 {
+			continue // fragmented: drop it and wait for the next datagram
+		}
+		return decodeSOCKS5UDPHeader(buf[:n])
+	}
+}
+
+// encodeSOCKS5UDPHeader builds the RSV(2) FRAG(1) ATYP(1) DST.ADDR DST.PORT
+// prefix required on every outgoing UDP ASSOCIATE datagram.
+func encodeSOCKS5UDPHeader(dst netip.AddrPort) []byte {
+	addr := dst.Addr()
+	var header []byte
+	if addr.Is4() {
+		header = make([]byte, 0, 4+4+2)
+		header = append(header, 0x00, 0x00, 0x00, 0x01)
+		ip4 := addr.As4()
+		header = append(header, ip4[:]...)
+	} else {
+		header = make([]byte, 0, 4+16+2)
+		header = append(header, 0x00, 0x00, 0x00, 0x04)
+		ip16 := addr.As16()
+		header = append(header, ip16[:]...)
+	}
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, dst.Port())
+	return append(header, port...)
+}
+
+// decodeSOCKS5UDPHeader parses the RSV/FRAG/ATYP/DST.ADDR/DST.PORT prefix
+// off an incoming relay datagram.
+func decodeSOCKS5UDPHeader(b []byte) (netip.AddrPort, []byte, error) {
+	if len(b) < 4 {
+		return netip.AddrPort{}, nil, fmt.Errorf("socks5 udp: short datagram (%d bytes)", len(b))
+	}
+	if b[2] != 0x00 {
+		return netip.AddrPort{}, nil, fmt.Errorf("socks5 udp: dropping fragmented datagram (FRAG=%d)", b[2])
+	}
+
+	atyp := b[3]
+	b = b[4:]
+
+	var addr netip.Addr
+	switch atyp {
+	case 0x01:
+		if len(b) < 4+2 {
+			return netip.AddrPort{}, nil, fmt.Errorf("socks5 udp: short ipv4 datagram")
+		}
+		addr = netip.AddrFrom4([4]byte(b[:4]))
+		b = b[4:]
+	case 0x04:
+		if len(b) < 16+2 {
+			return netip.AddrPort{}, nil, fmt.Errorf("socks5 udp: short ipv6 datagram")
+		}
+		addr = netip.AddrFrom16([16]byte(b[:16]))
+		b = b[16:]
+	case 0x03:
+		if len(b) < 1 {
+			return netip.AddrPort{}, nil, fmt.Errorf("socks5 udp: short domain datagram")
+		}
+		l := int(b[0])
+		b = b[1:]
+		if len(b) < l+2 {
+			return netip.AddrPort{}, nil, fmt.Errorf("socks5 udp: short domain datagram")
+		}
+		resolved, err := net.ResolveIPAddr("ip", string(b[:l]))
+		if err != nil {
+			return netip.AddrPort{}, nil, fmt.Errorf("socks5 udp: resolve %s: %w", b[:l], err)
+		}
+		addr, _ = netip.AddrFromSlice(resolved.IP)
+		b = b[l:]
+	default:
+		return netip.AddrPort{}, nil, fmt.Errorf("socks5 udp: unknown ATYP %d", atyp)
+	}
+
+	port := binary.BigEndian.Uint16(b[:2])
+	return netip.AddrPortFrom(addr, port), b[2:], nil
+}
@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestEncodeDecodeSOCKS5UDPHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		dst  netip.AddrPort
+	}{
+		{"ipv4", netip.MustParseAddrPort("192.168.1.1:53")},
+		{"ipv6", netip.MustParseAddrPort("[2001:db8::1]:443")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := []byte("hello")
+			header := encodeSOCKS5UDPHeader(tt.dst)
+			got, gotPayload, err := decodeSOCKS5UDPHeader(append(header, payload...))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if got != tt.dst {
+				t.Errorf("addr = %v, want %v", got, tt.dst)
+			}
+			if string(gotPayload) != string(payload) {
+				t.Errorf("payload = %q, want %q", gotPayload, payload)
+			}
+		})
+	}
+}
+
+func TestDecodeSOCKS5UDPHeaderDropsFragments(t *testing.T) {
+	b := []byte{0x00, 0x00, 0x01, 0x01, 127, 0, 0, 1, 0, 53, 'x'}
+	if _, _, err := decodeSOCKS5UDPHeader(b); err == nil {
+		t.Fatal("expected an error for FRAG != 0, got nil")
+	}
+}
+
+func TestDecodeSOCKS5UDPHeaderShortDatagram(t *testing.T) {
+	tests := [][]byte{
+		nil,
+		{0x00, 0x00, 0x00},             // missing ATYP
+		{0x00, 0x00, 0x00, 0x01, 1, 2}, // truncated ipv4 addr/port
+	}
+	for _, b := range tests {
+		if _, _, err := decodeSOCKS5UDPHeader(b); err == nil {
+			t.Errorf("decodeSOCKS5UDPHeader(%v): expected error, got nil", b)
+		}
+	}
+}
+
+func TestReadSOCKS5Reply(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go server.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x1F, 0x90})
+
+	addr, port, err := readSOCKS5Reply(client)
+	if err != nil {
+		t.Fatalf("readSOCKS5Reply: %v", err)
+	}
+	if addr != "127.0.0.1" || port != 8080 {
+		t.Errorf("got %s:%d, want 127.0.0.1:8080", addr, port)
+	}
+}
+
+func TestReadSOCKS5ReplyError(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go server.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	if _, _, err := readSOCKS5Reply(client); err == nil {
+		t.Fatal("expected an error for a non-zero reply code, got nil")
+	}
+}
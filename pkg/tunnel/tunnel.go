@@ -0,0 +1,228 @@
+// Package tunnel sets up a TUN device and routes the traffic that arrives
+// on it through a SOCKS5 proxy, entirely in-process.
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+const (
+	interfaceName = "utun69"
+	interfaceIP   = "172.16.0.1"
+	interfaceMask = "255.255.0.0"
+	interfaceMTU  = 1500
+	socksAddr     = "127.0.0.1:1080"
+)
+
+// Tunnel owns a native TUN device, an embedded SOCKS5 server, and the
+// userspace network stack that wires the two together.
+type Tunnel struct {
+	cfg    Config
+	device tun.Device
+	net    *netStack
+
+	routesMu sync.Mutex
+	routes   []string // CIDRs currently installed through the OS routing table
+}
+
+// New returns a Tunnel configured by cfg. It has not yet brought up an
+// interface or server.
+func New(cfg Config) *Tunnel {
+	return &Tunnel{cfg: cfg.withDefaults()}
+}
+
+// Start creates the TUN device, configures it and any requested routes,
+// starts the embedded SOCKS5 server, and wires the netstack to dial it for
+// every flow outside cfg.Exclude. It blocks until ctx is done, then tears
+// everything down.
+func (t *Tunnel) Start(ctx context.Context, routes ...string) error {
+	device, err := tun.CreateTUN(interfaceName, interfaceMTU)
+	if err != nil {
+		return fmt.Errorf("tunnel: create tun device: %w", err)
+	}
+	t.device = device
+
+	name, err := device.Name()
+	if err != nil {
+		name = interfaceName
+	}
+	recoverStaleRoutes(name)
+
+	if err := configureInterface(name, interfaceIP, interfaceMask); err != nil {
+		device.Close()
+		return fmt.Errorf("tunnel: configure interface: %w", err)
+	}
+	slog.Info("tunnel interface up", "name", name, "address", interfaceIP)
+
+	for _, route := range routes {
+		if err := t.AddRoute(route); err != nil {
+			device.Close()
+			return err
+		}
+	}
+	for _, prefix := range t.cfg.effectiveIncludes() {
+		if err := t.AddRoute(prefix.String()); err != nil {
+			device.Close()
+			return err
+		}
+	}
+
+	server := NewServer(t.cfg)
+	serverCtx, stopServer := context.WithCancel(ctx)
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.Serve(serverCtx) }()
+
+	ns, err := newNetStack(device, t.cfg)
+	if err != nil {
+		stopServer()
+		device.Close()
+		return fmt.Errorf("tunnel: start netstack: %w", err)
+	}
+	ns.SetExcludes(t.cfg.Exclude)
+	t.net = ns
+
+	select {
+	case <-ctx.Done():
+	case err := <-serverErr:
+		if err != nil {
+			slog.Error("socks5 server stopped", "error", err)
+		}
+	}
+	stopServer()
+	return t.Close()
+}
+
+// interfaceRealName returns the name the OS actually assigned the TUN
+// device, falling back to the requested name if it isn't up yet.
+func (t *Tunnel) interfaceRealName() string {
+	if t.device != nil {
+		if n, err := t.device.Name(); err == nil {
+			return n
+		}
+	}
+	return interfaceName
+}
+
+// AddRoute directs traffic for cidr through the tunnel interface.
+func (t *Tunnel) AddRoute(cidr string) error {
+	name := t.interfaceRealName()
+	if err := addRoute(name, cidr); err != nil {
+		return fmt.Errorf("tunnel: add route %s: %w", cidr, err)
+	}
+	slog.Info("route added", "cidr", cidr)
+
+	t.routesMu.Lock()
+	t.routes = append(t.routes, cidr)
+	routes := append([]string(nil), t.routes...)
+	t.routesMu.Unlock()
+	if err := saveRouteState(name, routes); err != nil {
+		slog.Warn("tunnel: failed to persist route state", "error", err)
+	}
+	return nil
+}
+
+// RemoveRoute stops directing traffic for cidr through the tunnel interface.
+func (t *Tunnel) RemoveRoute(cidr string) error {
+	name := t.interfaceRealName()
+	if err := removeRoute(name, cidr); err != nil {
+		return fmt.Errorf("tunnel: remove route %s: %w", cidr, err)
+	}
+	slog.Info("route removed", "cidr", cidr)
+
+	t.routesMu.Lock()
+	for i, r := range t.routes {
+		if r == cidr {
+			t.routes = append(t.routes[:i], t.routes[i+1:]...)
+			break
+		}
+	}
+	routes := append([]string(nil), t.routes...)
+	t.routesMu.Unlock()
+	if err := saveRouteState(name, routes); err != nil {
+		slog.Warn("tunnel: failed to persist route state", "error", err)
+	}
+	return nil
+}
+
+// RefreshRoutes reconciles the tunnel interface's routes and exclude list
+// with cfg's current Include/Exclude prefixes, without tearing down the
+// interface. Callers can mutate a Tunnel's routing rules at runtime by
+// calling RefreshRoutes with an updated Config.
+func (t *Tunnel) RefreshRoutes(ctx context.Context, cfg Config) error {
+	includes := cfg.effectiveIncludes()
+	wanted := make(map[string]bool, len(includes))
+	for _, p := range includes {
+		wanted[p.String()] = true
+	}
+
+	t.routesMu.Lock()
+	current := append([]string(nil), t.routes...)
+	t.routesMu.Unlock()
+
+	have := make(map[string]bool, len(current))
+	for _, cidr := range current {
+		have[cidr] = true
+		if !wanted[cidr] {
+			if err := t.RemoveRoute(cidr); err != nil {
+				return err
+			}
+		}
+	}
+	for cidr := range wanted {
+		if have[cidr] {
+			continue
+		}
+		if err := t.AddRoute(cidr); err != nil {
+			return err
+		}
+	}
+
+	t.cfg.Include = cfg.Include
+	t.cfg.Exclude = cfg.Exclude
+	if t.net != nil {
+		t.net.SetExcludes(cfg.Exclude)
+	}
+	slog.Info("routes refreshed", "include", len(includes), "exclude", len(cfg.Exclude))
+	return nil
+}
+
+// Close removes any routes the tunnel installed, then tears down the
+// netstack and the TUN device.
+func (t *Tunnel) Close() error {
+	t.routesMu.Lock()
+	routes := append([]string(nil), t.routes...)
+	t.routesMu.Unlock()
+	name := t.interfaceRealName()
+	for _, cidr := range routes {
+		if err := removeRoute(name, cidr); err != nil {
+			slog.Warn("tunnel: failed to remove route on shutdown", "cidr", cidr, "error", err)
+		}
+	}
+	clearRouteState(name)
+
+	if t.net != nil {
+		t.net.Close()
+	}
+	if t.device != nil {
+		err := t.device.Close()
+		if err != nil {
+			slog.Warn("tunnel interface down", "error", err)
+		} else {
+			slog.Info("tunnel interface down")
+		}
+		return err
+	}
+	return nil
+}
+
+// Start is a convenience wrapper for callers that don't need a handle to
+// the underlying Tunnel and are happy with the default Config.
+func Start(ctx context.Context, routes ...string) error {
+	return New(Config{}).Start(ctx, routes...)
+}
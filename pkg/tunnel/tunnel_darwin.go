@@ -1,34 +1,20 @@
 package tunnel
 
-import (
-	"context"
-	"log/slog"
-	"os"
-	"os/exec"
-	"runtime"
-	"time"
-)
+import "os/exec"
 
-func Start(ctx context.Context, routes ...string) error {
-	name := "utun69"
-	slog.Info("creating interface", "name", name, "os", runtime.GOOS)
-	socksCmd := exec.CommandContext(ctx, "tun2socks", "-device", name, "-proxy", "socks5://127.0.0.1:1080")
-	socksCmd.Stdout = os.Stdout
-	socksCmd.Stderr = os.Stderr
-	socksCmd.Start()
-	time.Sleep(time.Second * 1)
-	cmds := [][]string{
-		{"ifconfig", "utun69", "172.16.0.1", "172.16.0.1", "netmask", "255.255.0.0", "up"},
-		// {"ip", "link", "set", "dev", name, "up"},
-	}
-	// for _, route := range routes {
-	// 	cmds = append(cmds, []string{
-	// 		"route", "add", "-net", route, "172.16.0.1",
-	// 	})
-	// }
-	err := runCommands(cmds)
-	if err != nil {
-		return err
-	}
-	return socksCmd.Wait()
-}
\ No newline at end of file
+// configureInterface brings the TUN device up with a point-to-point
+// address. Darwin has no netlink equivalent, so this shells out to
+// ifconfig the same way wireguard-go itself does for interface setup.
+func configureInterface(name, address, mask string) error {
+	return exec.Command("ifconfig", name, address, address, "netmask", mask, "up").Run()
+}
+
+// addRoute directs traffic for cidr at the tunnel interface.
+func addRoute(name, cidr string) error {
+	return exec.Command("route", "add", "-net", cidr, interfaceIP).Run()
+}
+
+// removeRoute undoes addRoute.
+func removeRoute(name, cidr string) error {
+	return exec.Command("route", "delete", "-net", cidr, interfaceIP).Run()
+}
@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// configureInterface brings the TUN device up with a point-to-point
+// address via netlink.
+func configureInterface(name, address, mask string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("find link %s: %w", name, err)
+	}
+
+	ones, _ := net.IPMask(net.ParseIP(mask).To4()).Size()
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP(address), Mask: net.CIDRMask(ones, 32)}}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("add address %s: %w", address, err)
+	}
+
+	return netlink.LinkSetUp(link)
+}
+
+// addRoute directs traffic for cidr at the tunnel interface via netlink.
+func addRoute(name, cidr string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("find link %s: %w", name, err)
+	}
+	_, dst, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("parse cidr %s: %w", cidr, err)
+	}
+	return netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst})
+}
+
+// removeRoute undoes addRoute.
+func removeRoute(name, cidr string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("find link %s: %w", name, err)
+	}
+	_, dst, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("parse cidr %s: %w", cidr, err)
+	}
+	return netlink.RouteDel(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst})
+}
@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+// configureInterface brings the TUN device up with a point-to-point
+// address via the Windows IP Helper API (winipcfg), the same surface
+// wireguard-windows itself uses to manage its adapters.
+func configureInterface(name, address, mask string) error {
+	luid, err := luidForName(name)
+	if err != nil {
+		return err
+	}
+	ipNet := net.IPNet{IP: net.ParseIP(address), Mask: net.IPMask(net.ParseIP(mask).To4())}
+	return luid.SetIPAddresses([]net.IPNet{ipNet})
+}
+
+// addRoute directs traffic for cidr at the tunnel interface via winipcfg.
+func addRoute(name, cidr string) error {
+	luid, err := luidForName(name)
+	if err != nil {
+		return err
+	}
+	_, dst, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("parse cidr %s: %w", cidr, err)
+	}
+	return luid.AddRoute(*dst, net.IPv4zero, 0)
+}
+
+// removeRoute undoes addRoute.
+func removeRoute(name, cidr string) error {
+	luid, err := luidForName(name)
+	if err != nil {
+		return err
+	}
+	_, dst, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("parse cidr %s: %w", cidr, err)
+	}
+	return luid.DeleteRoute(*dst, net.IPv4zero)
+}
+
+// luidForName resolves the winipcfg.LUID for the adapter named name by
+// walking the IP Helper adapter list, since at this point in the shared
+// OS-hook API we only have the interface name to go on.
+func luidForName(name string) (winipcfg.LUID, error) {
+	adapters, err := winipcfg.GetAdaptersAddresses(windows.AF_UNSPEC, winipcfg.GAAFlagDefault)
+	if err != nil {
+		return 0, fmt.Errorf("enumerate adapters: %w", err)
+	}
+	for _, adapter := range adapters {
+		if adapter.FriendlyName() == name {
+			return adapter.LUID, nil
+		}
+	}
+	return 0, fmt.Errorf("no adapter named %q", name)
+}